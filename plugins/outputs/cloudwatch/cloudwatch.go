@@ -0,0 +1,1526 @@
+// Package cloudwatch contains a Telegraf output plugin that publishes
+// metrics to Amazon CloudWatch, either as CloudWatch metrics via
+// PutMetricData or, when configured, as Embedded Metric Format (EMF) log
+// records via PutLogEvents.
+package cloudwatch
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	cwltypes "github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/aws/smithy-go"
+
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/metric"
+	"github.com/influxdata/telegraf/plugins/outputs"
+	"github.com/influxdata/telegraf/selfstat"
+)
+
+//go:embed sample.conf
+var sampleConfig string
+
+// FieldRule applies a CloudWatch unit, storage resolution, and/or namespace
+// override to fields whose generated metric name matches NameGlob (a
+// path.Match-style glob, e.g. "*_ms" or "host_bytes_*").
+type FieldRule struct {
+	NameGlob          string `toml:"name_glob"`
+	Unit              string `toml:"unit"`
+	StorageResolution int32  `toml:"storage_resolution"`
+	NamespaceOverride string `toml:"namespace_override"`
+}
+
+const (
+	// maxDimensions is the number of dimensions CloudWatch allows on a
+	// single MetricDatum.
+	maxDimensions = 10
+	// defaultMaxDatumsPerCall is the number of datums CloudWatch currently
+	// allows on a single PutMetricData request.
+	defaultMaxDatumsPerCall = 1000
+	// maxPutMetricDataPayloadBytes is the CloudWatch PutMetricData request
+	// size limit; partitions are split further if they'd exceed it.
+	maxPutMetricDataPayloadBytes = 1_000_000
+	// defaultMaxConcurrentRequests bounds how many PutMetricData requests
+	// run at once when the user hasn't set max_concurrent_requests.
+	defaultMaxConcurrentRequests = 10
+	// defaultMaxRetryAttempts bounds retries of a throttled PutMetricData
+	// request when the user hasn't set max_retry_attempts.
+	defaultMaxRetryAttempts = 4
+	// initialThrottleBackoff is the delay before the first retry of a
+	// throttled request; it doubles on each subsequent attempt.
+	initialThrottleBackoff = 200 * time.Millisecond
+
+	outputModePutMetricData = "put_metric_data"
+	outputModeEMF           = "emf"
+
+	// CloudWatch rejects values outside this range (besides zero).
+	minCloudWatchValue = 8.515920e-109
+	maxCloudWatchValue = 1.174271e+108
+)
+
+// CloudWatch is an output plugin that writes Telegraf metrics to Amazon
+// CloudWatch.
+type CloudWatch struct {
+	Region      string `toml:"region"`
+	AccessKey   string `toml:"access_key"`
+	SecretKey   string `toml:"secret_key"`
+	RoleARN     string `toml:"role_arn"`
+	Profile     string `toml:"profile"`
+	Filename    string `toml:"shared_credential_file"`
+	Token       string `toml:"token"`
+	EndpointURL string `toml:"endpoint_url"`
+
+	Namespace             string `toml:"namespace"`
+	HighResolutionMetrics bool   `toml:"high_resolution_metrics"`
+	WriteStatistics       bool   `toml:"write_statistics"`
+
+	// WriteDistributions enables detection of pre-aggregated distribution
+	// fields (histogram buckets, or an explicit values/counts pair) and
+	// emits them as a MetricDatum with Values/Counts instead of Value or
+	// StatisticValues, so CloudWatch Metrics Insights can compute true
+	// percentiles server-side.
+	WriteDistributions bool `toml:"write_distributions"`
+
+	// FieldRules apply a unit, storage resolution and/or namespace to
+	// metric fields whose generated CloudWatch metric name (<name>_<field>)
+	// matches NameGlob. A metric's own "resolution" tag, or a
+	// "<field>_unit"/"<field>_resolution" tag, take precedence over a
+	// matching rule.
+	FieldRules []FieldRule `toml:"field_rules"`
+
+	// DimensionsInclude, if non-empty, restricts dimensions to these tag
+	// keys. DimensionsExclude drops tag keys even if included. Together
+	// they replace BuildDimensions' alphabetic top-10 heuristic whenever
+	// any dimension-selection option is set.
+	DimensionsInclude []string `toml:"dimensions_include"`
+	DimensionsExclude []string `toml:"dimensions_exclude"`
+	// DimensionsPriority orders tag keys before the maxDimensions
+	// truncation is applied; keys not listed sort alphabetically after it.
+	DimensionsPriority []string `toml:"dimensions_priority"`
+	// DimensionsReplacement, if set, keeps maxDimensions-1 tags and collapses
+	// the rest into a single dimension with this name, its value a hash of
+	// the dropped key=value pairs, instead of silently discarding them.
+	DimensionsReplacement string `toml:"dimensions_replacement"`
+
+	// CardinalityLimitPerMetric caps the number of distinct dimension-value
+	// combinations sent per metric name within a single Write call. Zero
+	// (the default) disables the guard.
+	CardinalityLimitPerMetric int `toml:"cardinality_limit_per_metric"`
+
+	// MetricNameTemplate and NamespaceTemplate, if set, are text/template
+	// strings evaluated per datum with {{.Name}}, {{.Field}} and
+	// {{.Tags.<tag>}} in scope, replacing the default "<name>_<field>"
+	// metric name and the Namespace setting respectively. A template that
+	// fails to execute for a given datum falls back to the default value
+	// for that datum.
+	MetricNameTemplate string `toml:"metric_name_template"`
+	NamespaceTemplate  string `toml:"namespace_template"`
+
+	// OutputMode selects how metrics are shipped to CloudWatch. The
+	// default, "put_metric_data", calls the CloudWatch PutMetricData API
+	// directly. "emf" instead serializes each datum as a CloudWatch
+	// Embedded Metric Format log record and ships it via PutLogEvents.
+	OutputMode    string     `toml:"output_mode"`
+	LogGroup      string     `toml:"log_group"`
+	LogStream     string     `toml:"log_stream"`
+	DimensionSets [][]string `toml:"dimension_sets"`
+
+	// MaxConcurrentRequests bounds how many PutMetricData requests are in
+	// flight at once. Defaults to defaultMaxConcurrentRequests.
+	MaxConcurrentRequests int `toml:"max_concurrent_requests"`
+	// MaxDatumsPerCall bounds how many datums go in a single PutMetricData
+	// request, before payload-size-aware splitting is applied. Defaults to
+	// defaultMaxDatumsPerCall.
+	MaxDatumsPerCall int `toml:"max_datums_per_call"`
+	// MaxRetryAttempts bounds how many times a throttled PutMetricData
+	// request is retried, with exponential backoff, before giving up.
+	// Defaults to defaultMaxRetryAttempts.
+	MaxRetryAttempts int `toml:"max_retry_attempts"`
+	// RequestsPerSecond rate-limits PutMetricData requests via a token
+	// bucket. Zero (the default) disables rate limiting.
+	RequestsPerSecond float64 `toml:"requests_per_second"`
+
+	Log telegraf.Logger `toml:"-"`
+
+	client        putMetricDataAPI
+	logsClient    *cloudwatchlogs.Client
+	sequenceToken *string
+	limiter       *tokenBucket
+
+	metricNameTmpl *template.Template
+	namespaceTmpl  *template.Template
+
+	datumsSent      selfstat.Stat
+	throttled       selfstat.Stat
+	partitionSplits selfstat.Stat
+}
+
+// templateData is the value passed to MetricNameTemplate/NamespaceTemplate.
+type templateData struct {
+	Name  string
+	Field string
+	Tags  map[string]string
+}
+
+func (*CloudWatch) SampleConfig() string {
+	return sampleConfig
+}
+
+// Init validates configuration that can be checked without a network round
+// trip.
+func (c *CloudWatch) Init() error {
+	switch c.OutputMode {
+	case "":
+		c.OutputMode = outputModePutMetricData
+	case outputModePutMetricData, outputModeEMF:
+	default:
+		return fmt.Errorf("unknown output_mode %q, must be %q or %q", c.OutputMode, outputModePutMetricData, outputModeEMF)
+	}
+
+	if c.OutputMode == outputModeEMF {
+		if c.LogGroup == "" || c.LogStream == "" {
+			return fmt.Errorf("log_group and log_stream are required when output_mode is %q", outputModeEMF)
+		}
+		if err := c.rejectIncompatibleEMFOptions(); err != nil {
+			return err
+		}
+	}
+
+	if c.MetricNameTemplate != "" {
+		tmpl, err := template.New("metric_name_template").Option("missingkey=error").Parse(c.MetricNameTemplate)
+		if err != nil {
+			return fmt.Errorf("parsing metric_name_template: %w", err)
+		}
+		c.metricNameTmpl = tmpl
+	}
+	if c.NamespaceTemplate != "" {
+		tmpl, err := template.New("namespace_template").Option("missingkey=error").Parse(c.NamespaceTemplate)
+		if err != nil {
+			return fmt.Errorf("parsing namespace_template: %w", err)
+		}
+		c.namespaceTmpl = tmpl
+	}
+
+	return nil
+}
+
+// rejectIncompatibleEMFOptions reports an error if a config option that only
+// put_metric_data's per-datum pipeline (applyFieldRules,
+// buildConfiguredDimensions, the cardinality guard, and the name/namespace
+// templates) knows how to honor is set alongside output_mode = "emf". EMF
+// records are built directly from each point's tags and fields rather than
+// from the MetricDatum batch those options were designed around, so rather
+// than silently ignoring them, fail fast at startup.
+func (c *CloudWatch) rejectIncompatibleEMFOptions() error {
+	var set []string
+	if len(c.FieldRules) > 0 {
+		set = append(set, "field_rules")
+	}
+	if c.dimensionsConfigured() {
+		set = append(set, "dimensions_include/dimensions_exclude/dimensions_priority/dimensions_replacement")
+	}
+	if c.CardinalityLimitPerMetric > 0 {
+		set = append(set, "cardinality_limit_per_metric")
+	}
+	if c.MetricNameTemplate != "" {
+		set = append(set, "metric_name_template")
+	}
+	if c.NamespaceTemplate != "" {
+		set = append(set, "namespace_template")
+	}
+	if len(set) > 0 {
+		return fmt.Errorf("output_mode %q does not support: %s", outputModeEMF, strings.Join(set, ", "))
+	}
+	return nil
+}
+
+// renderTemplate executes tmpl against data, reporting false (so the caller
+// falls back to its default behavior) when tmpl is nil or fails to execute.
+func renderTemplate(tmpl *template.Template, data templateData) (string, bool) {
+	if tmpl == nil {
+		return "", false
+	}
+	var buf strings.Builder
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", false
+	}
+	return buf.String(), true
+}
+
+func (c *CloudWatch) Connect() error {
+	cfg, err := c.credentials()
+	if err != nil {
+		return err
+	}
+
+	tags := map[string]string{"namespace": c.Namespace}
+	c.datumsSent = selfstat.Register("cloudwatch", "datums_sent", tags)
+	c.throttled = selfstat.Register("cloudwatch", "throttled", tags)
+	c.partitionSplits = selfstat.Register("cloudwatch", "partition_splits", tags)
+
+	if c.RequestsPerSecond > 0 {
+		c.limiter = newTokenBucket(c.RequestsPerSecond, c.maxConcurrentRequests())
+	}
+
+	if c.OutputMode == outputModeEMF {
+		c.logsClient = cloudwatchlogs.NewFromConfig(cfg, func(o *cloudwatchlogs.Options) {
+			if c.EndpointURL != "" {
+				o.BaseEndpoint = aws.String(c.EndpointURL)
+			}
+		})
+		return c.ensureLogStream()
+	}
+
+	c.client = cloudwatch.NewFromConfig(cfg, func(o *cloudwatch.Options) {
+		if c.EndpointURL != "" {
+			o.BaseEndpoint = aws.String(c.EndpointURL)
+		}
+	})
+	return nil
+}
+
+func (c *CloudWatch) maxConcurrentRequests() int {
+	if c.MaxConcurrentRequests > 0 {
+		return c.MaxConcurrentRequests
+	}
+	return defaultMaxConcurrentRequests
+}
+
+func (c *CloudWatch) maxDatumsPerCall() int {
+	if c.MaxDatumsPerCall > 0 {
+		return c.MaxDatumsPerCall
+	}
+	return defaultMaxDatumsPerCall
+}
+
+func (c *CloudWatch) maxRetryAttempts() int {
+	if c.MaxRetryAttempts > 0 {
+		return c.MaxRetryAttempts
+	}
+	return defaultMaxRetryAttempts
+}
+
+func (c *CloudWatch) credentials() (aws.Config, error) {
+	ctx := context.Background()
+
+	opts := []func(*awsconfig.LoadOptions) error{}
+	if c.Region != "" {
+		opts = append(opts, awsconfig.WithRegion(c.Region))
+	}
+	if c.Profile != "" {
+		opts = append(opts, awsconfig.WithSharedConfigProfile(c.Profile))
+	}
+	if c.Filename != "" {
+		opts = append(opts, awsconfig.WithSharedCredentialsFiles([]string{c.Filename}))
+	}
+	if c.AccessKey != "" || c.SecretKey != "" {
+		opts = append(opts, awsconfig.WithCredentialsProvider(
+			credentials.NewStaticCredentialsProvider(c.AccessKey, c.SecretKey, c.Token),
+		))
+	}
+
+	cfg, err := awsconfig.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return aws.Config{}, fmt.Errorf("loading AWS config: %w", err)
+	}
+
+	if c.RoleARN != "" {
+		stsClient := sts.NewFromConfig(cfg)
+		cfg.Credentials = aws.NewCredentialsCache(stscreds.NewAssumeRoleProvider(stsClient, c.RoleARN))
+	}
+
+	return cfg, nil
+}
+
+func (c *CloudWatch) Close() error {
+	return nil
+}
+
+func (c *CloudWatch) Write(metrics []telegraf.Metric) error {
+	if c.OutputMode == outputModeEMF {
+		return c.writeEMF(metrics)
+	}
+
+	rest := metrics
+	var datums []namespacedDatum
+
+	var cardinality *cardinalityTracker
+	if c.CardinalityLimitPerMetric > 0 {
+		cardinality = newCardinalityTracker(c.CardinalityLimitPerMetric, c.Log)
+	}
+
+	if c.WriteDistributions {
+		var distributions []distributionDatum
+		distributions, rest = c.buildDistributionDatums(metrics)
+		for _, d := range distributions {
+			datums = append(datums, c.finalizeDatums(d.point, d.dimTags, []types.MetricDatum{d.datum}, cardinality)...)
+		}
+	}
+
+	for _, m := range rest {
+		sanitized := stripReservedTags(m)
+		built := BuildMetricDatum(c.WriteStatistics, c.HighResolutionMetrics, sanitized)
+		datums = append(datums, c.finalizeDatums(m, sanitized.Tags(), built, cardinality)...)
+	}
+
+	return c.writePutMetricData(datums)
+}
+
+// finalizeDatums applies field-rule unit/resolution overrides, configured
+// dimension selection, name/namespace templating, and the cardinality guard
+// to built, a batch of MetricDatum all derived from point. dimTags is the
+// (already reserved-tag-stripped) tag set dimension selection should see.
+func (c *CloudWatch) finalizeDatums(point telegraf.Metric, dimTags map[string]string, built []types.MetricDatum, cardinality *cardinalityTracker) []namespacedDatum {
+	built = c.applyFieldRules(point, built)
+
+	if c.dimensionsConfigured() {
+		dims := c.buildConfiguredDimensions(dimTags)
+		for i := range built {
+			built[i].Dimensions = dims
+		}
+	}
+
+	var out []namespacedDatum
+	for i := range built {
+		field := strings.TrimPrefix(*built[i].MetricName, point.Name()+"_")
+		tmplData := templateData{Name: point.Name(), Field: field, Tags: point.Tags()}
+
+		namespace := c.Namespace
+		if rule, ok := matchFieldRule(c.FieldRules, *built[i].MetricName); ok && rule.NamespaceOverride != "" {
+			namespace = rule.NamespaceOverride
+		} else if ns, ok := renderTemplate(c.namespaceTmpl, tmplData); ok {
+			namespace = ns
+		}
+
+		if name, ok := renderTemplate(c.metricNameTmpl, tmplData); ok {
+			built[i].MetricName = aws.String(name)
+		}
+
+		if cardinality != nil && !cardinality.allow(*built[i].MetricName, built[i].Dimensions) {
+			continue
+		}
+
+		out = append(out, namespacedDatum{namespace: namespace, datum: built[i]})
+	}
+	return out
+}
+
+// namespacedDatum pairs a MetricDatum with the namespace it should be sent
+// under, so a FieldRule's namespace_override can route specific metrics to
+// a different CloudWatch namespace in the same Write call.
+type namespacedDatum struct {
+	namespace string
+	datum     types.MetricDatum
+}
+
+// writePutMetricData sends datums grouped by namespace, splitting each
+// namespace's datums into partitions that respect both the datum-count cap
+// and the CloudWatch payload-size limit, and sends those partitions
+// concurrently (bounded by maxConcurrentRequests), retrying throttled
+// requests with exponential backoff.
+func (c *CloudWatch) writePutMetricData(datums []namespacedDatum) error {
+	byNamespace := make(map[string][]types.MetricDatum, 1)
+	var namespaces []string
+	for _, d := range datums {
+		if _, ok := byNamespace[d.namespace]; !ok {
+			namespaces = append(namespaces, d.namespace)
+		}
+		byNamespace[d.namespace] = append(byNamespace[d.namespace], d.datum)
+	}
+
+	sem := make(chan struct{}, c.maxConcurrentRequests())
+	var wg sync.WaitGroup
+	errOnce := sync.Once{}
+	var firstErr error
+
+	for _, namespace := range namespaces {
+		partitions, splits := partitionDatumsAdaptive(c.maxDatumsPerCall(), byNamespace[namespace])
+		if splits > 0 && c.partitionSplits != nil {
+			c.partitionSplits.Incr(int64(splits))
+		}
+
+		for _, partition := range partitions {
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(namespace string, partition []types.MetricDatum) {
+				defer wg.Done()
+				defer func() { <-sem }()
+
+				if err := c.putMetricDataWithRetry(namespace, partition); err != nil {
+					errOnce.Do(func() { firstErr = err })
+				}
+			}(namespace, partition)
+		}
+	}
+
+	wg.Wait()
+	return firstErr
+}
+
+// putMetricDataAPI is the subset of *cloudwatch.Client this plugin calls,
+// narrowed to an interface so the retry/backoff/concurrency logic in
+// putMetricDataWithRetry can be exercised against a fake in tests.
+type putMetricDataAPI interface {
+	PutMetricData(ctx context.Context, params *cloudwatch.PutMetricDataInput, optFns ...func(*cloudwatch.Options)) (*cloudwatch.PutMetricDataOutput, error)
+}
+
+// putMetricDataWithRetry sends a single PutMetricData request, retrying on
+// Throttling/RequestLimitExceeded errors with exponential backoff up to
+// maxRetryAttempts.
+func (c *CloudWatch) putMetricDataWithRetry(namespace string, partition []types.MetricDatum) error {
+	ctx := context.Background()
+	backoff := initialThrottleBackoff
+
+	for attempt := 0; ; attempt++ {
+		if c.limiter != nil {
+			c.limiter.take()
+		}
+
+		_, err := c.client.PutMetricData(ctx, &cloudwatch.PutMetricDataInput{
+			Namespace:  aws.String(namespace),
+			MetricData: partition,
+		})
+		if err == nil {
+			if c.datumsSent != nil {
+				c.datumsSent.Incr(int64(len(partition)))
+			}
+			return nil
+		}
+
+		if !isThrottlingError(err) || attempt >= c.maxRetryAttempts() {
+			return fmt.Errorf("unable to write to CloudWatch: %w", err)
+		}
+
+		if c.throttled != nil {
+			c.throttled.Incr(1)
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// isThrottlingError reports whether err is a CloudWatch throttling response
+// worth retrying.
+func isThrottlingError(err error) bool {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	switch apiErr.ErrorCode() {
+	case "Throttling", "ThrottlingException", "RequestLimitExceeded":
+		return true
+	default:
+		return false
+	}
+}
+
+// partitionDatumsAdaptive splits datums into count-bounded partitions via
+// PartitionDatums, then further splits any partition whose estimated
+// serialized size would exceed maxPutMetricDataPayloadBytes. extraSplits
+// reports how many additional partitions were created by the size split, for
+// the cloudwatch_partition_splits counter.
+func partitionDatumsAdaptive(maxCount int, datums []types.MetricDatum) (partitions [][]types.MetricDatum, extraSplits int) {
+	for _, chunk := range PartitionDatums(maxCount, datums) {
+		split := splitDatumsBySize(chunk, maxPutMetricDataPayloadBytes)
+		if len(split) > 1 {
+			extraSplits += len(split) - 1
+		}
+		partitions = append(partitions, split...)
+	}
+	return partitions, extraSplits
+}
+
+// splitDatumsBySize greedily packs datums into partitions that each stay
+// under maxBytes of estimated serialized size.
+func splitDatumsBySize(datums []types.MetricDatum, maxBytes int) [][]types.MetricDatum {
+	var partitions [][]types.MetricDatum
+	var current []types.MetricDatum
+	currentSize := 0
+
+	for _, d := range datums {
+		size := estimateDatumSize(d)
+		if len(current) > 0 && currentSize+size > maxBytes {
+			partitions = append(partitions, current)
+			current = nil
+			currentSize = 0
+		}
+		current = append(current, d)
+		currentSize += size
+	}
+	if len(current) > 0 {
+		partitions = append(partitions, current)
+	}
+	return partitions
+}
+
+// estimateDatumSize approximates the wire size of a single MetricDatum by
+// JSON-encoding it; falls back to a conservative guess if that fails.
+func estimateDatumSize(d types.MetricDatum) int {
+	encoded, err := json.Marshal(d)
+	if err != nil {
+		return 512
+	}
+	return len(encoded)
+}
+
+// tokenBucket is a minimal token-bucket rate limiter used to cap the rate of
+// outgoing PutMetricData requests.
+type tokenBucket struct {
+	mu     sync.Mutex
+	tokens float64
+	max    float64
+	rate   float64
+	last   time.Time
+}
+
+func newTokenBucket(ratePerSecond float64, burst int) *tokenBucket {
+	return &tokenBucket{
+		tokens: float64(burst),
+		max:    float64(burst),
+		rate:   ratePerSecond,
+		last:   time.Now(),
+	}
+}
+
+// take blocks, if necessary, until a token is available.
+func (b *tokenBucket) take() {
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens = math.Min(b.max, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+
+	// Taking a token may leave the bucket in debt; each waiter sleeps until
+	// its own token has been refilled, so concurrent callers stay in line.
+	b.tokens--
+	if b.tokens < 0 {
+		wait := time.Duration(-b.tokens / b.rate * float64(time.Second))
+		b.mu.Unlock()
+		time.Sleep(wait)
+		return
+	}
+	b.mu.Unlock()
+}
+
+// BuildDimensions converts metric tags into CloudWatch dimensions. Tags with
+// empty values are skipped, since CloudWatch rejects empty dimension values.
+// Only the first maxDimensions (alphabetically, by tag key) are kept,
+// because CloudWatch rejects a MetricDatum with more than that.
+func BuildDimensions(tags map[string]string) []types.Dimension {
+	keys := make([]string, 0, len(tags))
+	for k, v := range tags {
+		if v == "" {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	if len(keys) > maxDimensions {
+		keys = keys[:maxDimensions]
+	}
+
+	dimensions := make([]types.Dimension, 0, len(keys))
+	for _, k := range keys {
+		dimensions = append(dimensions, types.Dimension{
+			Name:  aws.String(k),
+			Value: aws.String(tags[k]),
+		})
+	}
+	return dimensions
+}
+
+// dimensionsConfigured reports whether any dimension-selection option is
+// set, so buildConfiguredDimensions is only used in place of the default
+// BuildDimensions heuristic when the user has actually opted in.
+func (c *CloudWatch) dimensionsConfigured() bool {
+	return len(c.DimensionsInclude) > 0 || len(c.DimensionsExclude) > 0 ||
+		len(c.DimensionsPriority) > 0 || c.DimensionsReplacement != ""
+}
+
+// buildConfiguredDimensions replaces BuildDimensions' alphabetic top-10
+// heuristic with dimensions_include/exclude/priority/replacement: tags are
+// filtered by include/exclude, ordered by priority (ties broken
+// alphabetically), and truncated to maxDimensions. If dimensions_replacement
+// is set and truncation is needed, only maxDimensions-1 tags are kept and the
+// dropped tags are collapsed into one final dimension carrying a hash of
+// their key=value pairs instead of being discarded.
+func (c *CloudWatch) buildConfiguredDimensions(tags map[string]string) []types.Dimension {
+	include := make(map[string]bool, len(c.DimensionsInclude))
+	for _, k := range c.DimensionsInclude {
+		include[k] = true
+	}
+	exclude := make(map[string]bool, len(c.DimensionsExclude))
+	for _, k := range c.DimensionsExclude {
+		exclude[k] = true
+	}
+
+	var keys []string
+	for k, v := range tags {
+		if v == "" || exclude[k] {
+			continue
+		}
+		if len(include) > 0 && !include[k] {
+			continue
+		}
+		keys = append(keys, k)
+	}
+
+	ordered := orderDimensionKeys(keys, c.DimensionsPriority)
+	if len(ordered) <= maxDimensions {
+		return dimensionsFromKeys(ordered, tags)
+	}
+
+	if c.DimensionsReplacement == "" {
+		return dimensionsFromKeys(ordered[:maxDimensions], tags)
+	}
+
+	kept, dropped := ordered[:maxDimensions-1], ordered[maxDimensions-1:]
+
+	droppedPairs := make([]string, len(dropped))
+	for i, k := range dropped {
+		droppedPairs[i] = k + "=" + tags[k]
+	}
+	sort.Strings(droppedPairs)
+
+	dims := dimensionsFromKeys(kept, tags)
+	return append(dims, types.Dimension{
+		Name:  aws.String(c.DimensionsReplacement),
+		Value: aws.String(hashTagPairs(droppedPairs)),
+	})
+}
+
+// orderDimensionKeys places keys in priority order (only those present),
+// followed by the rest sorted alphabetically.
+func orderDimensionKeys(keys []string, priority []string) []string {
+	present := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		present[k] = true
+	}
+	inPriority := make(map[string]bool, len(priority))
+
+	ordered := make([]string, 0, len(keys))
+	for _, k := range priority {
+		if present[k] && !inPriority[k] {
+			ordered = append(ordered, k)
+			inPriority[k] = true
+		}
+	}
+
+	var rest []string
+	for _, k := range keys {
+		if !inPriority[k] {
+			rest = append(rest, k)
+		}
+	}
+	sort.Strings(rest)
+
+	return append(ordered, rest...)
+}
+
+func dimensionsFromKeys(keys []string, tags map[string]string) []types.Dimension {
+	dims := make([]types.Dimension, 0, len(keys))
+	for _, k := range keys {
+		dims = append(dims, types.Dimension{Name: aws.String(k), Value: aws.String(tags[k])})
+	}
+	return dims
+}
+
+func hashTagPairs(pairs []string) string {
+	h := fnv.New64a()
+	for _, p := range pairs {
+		h.Write([]byte(p))
+		h.Write([]byte{0})
+	}
+	return strconv.FormatUint(h.Sum64(), 16)
+}
+
+// cardinalityTracker enforces CardinalityLimitPerMetric by tracking, per
+// metric name, the distinct dimension-value combinations seen so far within
+// one Write call (a "flush window"). It logs once per metric name the first
+// time the limit causes a datum to be dropped.
+type cardinalityTracker struct {
+	limit  int
+	log    telegraf.Logger
+	seen   map[string]map[string]bool
+	warned map[string]bool
+}
+
+func newCardinalityTracker(limit int, log telegraf.Logger) *cardinalityTracker {
+	return &cardinalityTracker{
+		limit:  limit,
+		log:    log,
+		seen:   make(map[string]map[string]bool),
+		warned: make(map[string]bool),
+	}
+}
+
+func (t *cardinalityTracker) allow(metricName string, dims []types.Dimension) bool {
+	signature := dimensionSignature(dims)
+
+	combos, ok := t.seen[metricName]
+	if !ok {
+		combos = make(map[string]bool)
+		t.seen[metricName] = combos
+	}
+	if combos[signature] {
+		return true
+	}
+
+	if len(combos) >= t.limit {
+		if !t.warned[metricName] && t.log != nil {
+			t.warned[metricName] = true
+			t.log.Warnf("cloudwatch: dropping %q datums beyond cardinality_limit_per_metric (%d)", metricName, t.limit)
+		}
+		return false
+	}
+
+	combos[signature] = true
+	return true
+}
+
+func dimensionSignature(dims []types.Dimension) string {
+	pairs := make([]string, len(dims))
+	for i, d := range dims {
+		pairs[i] = aws.ToString(d.Name) + "=" + aws.ToString(d.Value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ";")
+}
+
+// BuildMetricDatum converts a single Telegraf metric into zero or more
+// CloudWatch MetricDatum values. When buildStatistic is true, fields that
+// form a complete "<name>_max"/"_min"/"_sum"/"_count" quartet of valid values
+// are combined into a single datum using StatisticValues instead of Value;
+// otherwise they are sent one datum per field. Fields with
+// non-numeric or out-of-range values are skipped, since CloudWatch rejects
+// them.
+func BuildMetricDatum(buildStatistic bool, highResolutionMetrics bool, point telegraf.Metric) []types.MetricDatum {
+	fields := point.Fields()
+
+	var resolution int32 = 60
+	if highResolutionMetrics {
+		resolution = 1
+	}
+
+	var datums []types.MetricDatum
+	handled := make(map[string]bool, len(fields))
+
+	if buildStatistic {
+		for _, base := range statisticBaseNames(fields) {
+			maxV, maxOk := numericField(fields, base+"_max")
+			minV, minOk := numericField(fields, base+"_min")
+			sumV, sumOk := numericField(fields, base+"_sum")
+			countV, countOk := numericField(fields, base+"_count")
+			if !(maxOk && minOk && sumOk && countOk) {
+				continue
+			}
+			if !validCloudWatchValue(maxV) || !validCloudWatchValue(minV) ||
+				!validCloudWatchValue(sumV) || !validCloudWatchValue(countV) {
+				continue
+			}
+
+			datums = append(datums, types.MetricDatum{
+				MetricName: aws.String(strings.Join([]string{point.Name(), base}, "_")),
+				Dimensions: BuildDimensions(point.Tags()),
+				Timestamp:  aws.Time(point.Time()),
+				StatisticValues: &types.StatisticSet{
+					Maximum:     aws.Float64(maxV),
+					Minimum:     aws.Float64(minV),
+					Sum:         aws.Float64(sumV),
+					SampleCount: aws.Float64(countV),
+				},
+				StorageResolution: aws.Int32(resolution),
+				Unit:              types.StandardUnitNone,
+			})
+			handled[base+"_max"] = true
+			handled[base+"_min"] = true
+			handled[base+"_sum"] = true
+			handled[base+"_count"] = true
+		}
+	}
+
+	for field := range fields {
+		if handled[field] {
+			continue
+		}
+
+		value, ok := numericField(fields, field)
+		if !ok || !validCloudWatchValue(value) {
+			continue
+		}
+
+		datums = append(datums, types.MetricDatum{
+			MetricName:        aws.String(strings.Join([]string{point.Name(), field}, "_")),
+			Dimensions:        BuildDimensions(point.Tags()),
+			Timestamp:         aws.Time(point.Time()),
+			Value:             aws.Float64(value),
+			StorageResolution: aws.Int32(resolution),
+			Unit:              types.StandardUnitNone,
+		})
+	}
+
+	return datums
+}
+
+// statisticBaseNames returns the set of field-name prefixes that have at
+// least one of the four statistic suffixes present, so the caller only has
+// to look up full quartets for plausible candidates.
+func statisticBaseNames(fields map[string]interface{}) []string {
+	suffixes := [...]string{"_max", "_min", "_sum", "_count"}
+
+	seen := make(map[string]bool)
+	var bases []string
+	for field := range fields {
+		for _, suffix := range suffixes {
+			if base, ok := strings.CutSuffix(field, suffix); ok {
+				if !seen[base] {
+					seen[base] = true
+					bases = append(bases, base)
+				}
+				break
+			}
+		}
+	}
+	return bases
+}
+
+// numericField returns the named field as a float64, if it exists and is a
+// type CloudWatch can represent.
+func numericField(fields map[string]interface{}, name string) (float64, bool) {
+	v, ok := fields[name]
+	if !ok {
+		return 0, false
+	}
+	return convertField(v)
+}
+
+func convertField(v interface{}) (float64, bool) {
+	switch value := v.(type) {
+	case float64:
+		return value, true
+	case float32:
+		return float64(value), true
+	case int64:
+		return float64(value), true
+	case int32:
+		return float64(value), true
+	case int:
+		return float64(value), true
+	case uint64:
+		return float64(value), true
+	case bool:
+		if value {
+			return 1, true
+		}
+		return 0, true
+	default:
+		return 0, false
+	}
+}
+
+// validCloudWatchValue reports whether v is in the range CloudWatch accepts
+// for a MetricDatum value. Zero is always accepted; CloudWatch otherwise
+// rejects magnitudes outside [8.515920e-109, 1.174271e+108] as well as NaN
+// and Inf.
+func validCloudWatchValue(v float64) bool {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return false
+	}
+	if v == 0 {
+		return true
+	}
+	abs := math.Abs(v)
+	return abs >= minCloudWatchValue && abs <= maxCloudWatchValue
+}
+
+// maxDistributionValues is the number of (value, count) pairs CloudWatch
+// accepts on a single MetricDatum.Values/Counts pair.
+const maxDistributionValues = 150
+
+// buildDistributionDatums extracts pre-aggregated distributions from
+// metrics and turns them into MetricDatum values using Values/Counts. It
+// recognizes two shapes:
+//
+//   - an explicit "values"/"counts" field pair on a single metric, as
+//     produced by telegraf's histogram aggregator in "values" mode
+//   - cumulative histogram buckets spread across several metrics that
+//     share a name, timestamp and tag set (besides the "le" tag), as
+//     produced by telegraf's histogram aggregator in its default mode
+//
+// Metrics that don't match either shape are returned unchanged in rest, for
+// the caller to pass through BuildMetricDatum as usual.
+//
+// Each returned distributionDatum carries, alongside the MetricDatum itself,
+// the telegraf.Metric and dimension tags it was derived from, so the caller
+// can route it through the same field-rule, dimension-selection, cardinality
+// and templating logic applied to every other datum.
+func (c *CloudWatch) buildDistributionDatums(metrics []telegraf.Metric) (distributions []distributionDatum, rest []telegraf.Metric) {
+	resolution := int32(60)
+	if c.HighResolutionMetrics {
+		resolution = 1
+	}
+
+	type bucketGroupKey struct {
+		name string
+		tags string
+		time time.Time
+	}
+	var groupOrder []bucketGroupKey
+	groups := make(map[bucketGroupKey][]telegraf.Metric)
+
+	for _, m := range metrics {
+		if values, counts, ok := explicitDistributionFields(m.Fields()); ok {
+			name := strings.Join([]string{m.Name(), "value"}, "_")
+			sanitized := stripReservedTags(m)
+			for _, d := range splitDistributionDatums(name, sanitized.Tags(), m.Time(), resolution, values, counts) {
+				distributions = append(distributions, distributionDatum{point: m, dimTags: sanitized.Tags(), datum: d})
+			}
+			continue
+		}
+
+		if le, ok := m.Tags()["le"]; ok && hasBucketField(m.Fields()) {
+			_ = le
+			key := bucketGroupKey{name: m.Name(), tags: tagsKeyWithout(m.Tags(), "le"), time: m.Time()}
+			if _, seen := groups[key]; !seen {
+				groupOrder = append(groupOrder, key)
+			}
+			groups[key] = append(groups[key], m)
+			continue
+		}
+
+		rest = append(rest, m)
+	}
+
+	for _, key := range groupOrder {
+		group := groups[key]
+		groupTags := withoutTag(group[0].Tags(), "le")
+		groupPoint := metric.New(key.name, groupTags, map[string]interface{}{}, key.time)
+		sanitizedPoint := stripReservedTags(groupPoint)
+		for _, field := range bucketFieldNames(group) {
+			values, counts := bucketsToDistribution(group, field)
+			name := strings.Join([]string{key.name, strings.TrimSuffix(field, "_bucket")}, "_")
+			for _, d := range splitDistributionDatums(name, sanitizedPoint.Tags(), key.time, resolution, values, counts) {
+				distributions = append(distributions, distributionDatum{point: groupPoint, dimTags: sanitizedPoint.Tags(), datum: d})
+			}
+		}
+	}
+
+	return distributions, rest
+}
+
+// distributionDatum pairs a distribution MetricDatum with the metric and
+// dimension tags it was built from, so it can be routed through the same
+// per-datum pipeline (field rules, dimension selection, cardinality,
+// templating) as a datum built by BuildMetricDatum.
+type distributionDatum struct {
+	point   telegraf.Metric
+	dimTags map[string]string
+	datum   types.MetricDatum
+}
+
+// explicitDistributionFields recognizes a "values"/"counts" field pair of
+// equal-length numeric slices.
+func explicitDistributionFields(fields map[string]interface{}) ([]float64, []float64, bool) {
+	rawValues, ok := fields["values"]
+	if !ok {
+		return nil, nil, false
+	}
+	rawCounts, ok := fields["counts"]
+	if !ok {
+		return nil, nil, false
+	}
+
+	values, ok := toFloatSlice(rawValues)
+	if !ok {
+		return nil, nil, false
+	}
+	counts, ok := toFloatSlice(rawCounts)
+	if !ok || len(counts) != len(values) {
+		return nil, nil, false
+	}
+	return values, counts, true
+}
+
+func toFloatSlice(v interface{}) ([]float64, bool) {
+	switch s := v.(type) {
+	case []float64:
+		return s, true
+	case []interface{}:
+		out := make([]float64, 0, len(s))
+		for _, e := range s {
+			f, ok := convertField(e)
+			if !ok {
+				return nil, false
+			}
+			out = append(out, f)
+		}
+		return out, true
+	default:
+		return nil, false
+	}
+}
+
+// hasBucketField reports whether any field name ends in "_bucket", the
+// suffix telegraf's histogram aggregator uses for cumulative bucket counts.
+func hasBucketField(fields map[string]interface{}) bool {
+	for field := range fields {
+		if strings.HasSuffix(field, "_bucket") {
+			return true
+		}
+	}
+	return false
+}
+
+// bucketFieldNames returns the set of "_bucket"-suffixed field names present
+// across a group of same-timestamp metrics.
+func bucketFieldNames(group []telegraf.Metric) []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, m := range group {
+		for field := range m.Fields() {
+			if strings.HasSuffix(field, "_bucket") && !seen[field] {
+				seen[field] = true
+				names = append(names, field)
+			}
+		}
+	}
+	return names
+}
+
+// bucketsToDistribution converts a group of histogram bucket metrics,
+// cumulative per the Prometheus convention telegraf's histogram aggregator
+// follows, into (value, count) pairs suitable for MetricDatum.Values/Counts.
+// Each bucket's value is its "le" upper bound, and its count is the
+// increase over the previous (smaller) bucket. Telegraf's histogram
+// aggregator always emits a final "le=+Inf" bucket to carry the cumulative
+// total; that bucket (and any other non-finite or out-of-range "le") is
+// dropped rather than passed to CloudWatch, which rejects such values.
+func bucketsToDistribution(group []telegraf.Metric, field string) (values, counts []float64) {
+	type bucket struct {
+		le         float64
+		cumulative float64
+	}
+	var buckets []bucket
+	for _, m := range group {
+		le, err := strconv.ParseFloat(m.Tags()["le"], 64)
+		if err != nil || !validCloudWatchValue(le) {
+			continue
+		}
+		count, ok := numericField(m.Fields(), field)
+		if !ok {
+			continue
+		}
+		buckets = append(buckets, bucket{le: le, cumulative: count})
+	}
+
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].le < buckets[j].le })
+
+	var previous float64
+	for _, b := range buckets {
+		count := b.cumulative - previous
+		previous = b.cumulative
+		if count <= 0 || !validCloudWatchValue(count) {
+			continue
+		}
+		values = append(values, b.le)
+		counts = append(counts, count)
+	}
+	return values, counts
+}
+
+// splitDistributionDatums builds one or more MetricDatum from a (values,
+// counts) distribution, splitting into multiple datums of at most
+// maxDistributionValues entries each, since CloudWatch rejects a single
+// MetricDatum with more Values than that. Pairs with a non-finite or
+// out-of-range value or count are dropped, since CloudWatch rejects those
+// too.
+func splitDistributionDatums(name string, tags map[string]string, timestamp time.Time, resolution int32, values, counts []float64) []types.MetricDatum {
+	values, counts = filterValidDistributionPairs(values, counts)
+
+	var datums []types.MetricDatum
+	for offset := 0; offset < len(values); offset += maxDistributionValues {
+		end := offset + maxDistributionValues
+		if end > len(values) {
+			end = len(values)
+		}
+		datums = append(datums, types.MetricDatum{
+			MetricName:        aws.String(name),
+			Dimensions:        BuildDimensions(tags),
+			Timestamp:         aws.Time(timestamp),
+			Values:            append([]float64(nil), values[offset:end]...),
+			Counts:            append([]float64(nil), counts[offset:end]...),
+			StorageResolution: aws.Int32(resolution),
+			Unit:              types.StandardUnitNone,
+		})
+	}
+	return datums
+}
+
+// filterValidDistributionPairs drops any (value, count) pair CloudWatch
+// would reject, keeping the rest in their original order.
+func filterValidDistributionPairs(values, counts []float64) ([]float64, []float64) {
+	filteredValues := make([]float64, 0, len(values))
+	filteredCounts := make([]float64, 0, len(counts))
+	for i, v := range values {
+		if !validCloudWatchValue(v) || !validCloudWatchValue(counts[i]) {
+			continue
+		}
+		filteredValues = append(filteredValues, v)
+		filteredCounts = append(filteredCounts, counts[i])
+	}
+	return filteredValues, filteredCounts
+}
+
+func tagsKeyWithout(tags map[string]string, excluded string) string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		if k == excluded {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, k := range keys {
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(tags[k])
+		b.WriteByte(';')
+	}
+	return b.String()
+}
+
+func withoutTag(tags map[string]string, excluded string) map[string]string {
+	out := make(map[string]string, len(tags))
+	for k, v := range tags {
+		if k != excluded {
+			out[k] = v
+		}
+	}
+	return out
+}
+
+// reservedTag reports whether a tag key is one of the control tags this
+// plugin recognizes rather than treating as a CloudWatch dimension: the
+// global "resolution" tag, and a "<field>_unit"/"<field>_resolution"
+// per-field override, but only when "<field>" names one of the metric's own
+// fields — an unrelated tag that happens to end in "_unit"/"_resolution"
+// (e.g. "screen_resolution") is left alone.
+func reservedTag(key string, fields map[string]interface{}) bool {
+	if key == "resolution" {
+		return true
+	}
+	if field := strings.TrimSuffix(key, "_unit"); field != key {
+		_, ok := fields[field]
+		return ok
+	}
+	if field := strings.TrimSuffix(key, "_resolution"); field != key {
+		_, ok := fields[field]
+		return ok
+	}
+	return false
+}
+
+func hasReservedTags(tags map[string]string, fields map[string]interface{}) bool {
+	for k := range tags {
+		if reservedTag(k, fields) {
+			return true
+		}
+	}
+	return false
+}
+
+// stripReservedTags returns point unchanged unless it carries reserved
+// control tags, in which case it returns a copy with those tags removed so
+// they don't leak into BuildDimensions as ordinary CloudWatch dimensions.
+func stripReservedTags(point telegraf.Metric) telegraf.Metric {
+	if !hasReservedTags(point.Tags(), point.Fields()) {
+		return point
+	}
+
+	filtered := make(map[string]string, len(point.Tags()))
+	for k, v := range point.Tags() {
+		if !reservedTag(k, point.Fields()) {
+			filtered[k] = v
+		}
+	}
+	return metric.New(point.Name(), filtered, point.Fields(), point.Time())
+}
+
+// matchFieldRule returns the first FieldRule whose NameGlob matches name
+// (the generated "<metric>_<field>" CloudWatch metric name).
+func matchFieldRule(rules []FieldRule, name string) (FieldRule, bool) {
+	for _, r := range rules {
+		if ok, err := path.Match(r.NameGlob, name); ok && err == nil {
+			return r, true
+		}
+	}
+	return FieldRule{}, false
+}
+
+// validUnit looks up unit against the CloudWatch StandardUnit enum.
+func validUnit(unit string) (types.StandardUnit, bool) {
+	for _, u := range types.StandardUnitNone.Values() {
+		if string(u) == unit {
+			return u, true
+		}
+	}
+	return "", false
+}
+
+// applyFieldRules overrides each datum's Unit and StorageResolution using,
+// in order of precedence: a "<field>_unit"/"<field>_resolution" tag on the
+// original (pre-sanitization) point, the point's "resolution" tag, and any
+// matching FieldRule.
+func (c *CloudWatch) applyFieldRules(point telegraf.Metric, datums []types.MetricDatum) []types.MetricDatum {
+	if len(c.FieldRules) == 0 && !hasReservedTags(point.Tags(), point.Fields()) {
+		return datums
+	}
+
+	tags := point.Tags()
+	highResTag := tags["resolution"] == "high"
+
+	for i := range datums {
+		field := strings.TrimPrefix(*datums[i].MetricName, point.Name()+"_")
+		rule, hasRule := matchFieldRule(c.FieldRules, *datums[i].MetricName)
+
+		unit := ""
+		if hasRule {
+			unit = rule.Unit
+		}
+		if tagUnit, ok := tags[field+"_unit"]; ok {
+			unit = tagUnit
+		}
+		if unit != "" {
+			if parsed, ok := validUnit(unit); ok {
+				datums[i].Unit = parsed
+			} else if c.Log != nil {
+				c.Log.Warnf("cloudwatch: ignoring unknown unit %q for field %q", unit, field)
+			}
+		}
+
+		resolution := aws.ToInt32(datums[i].StorageResolution)
+		if hasRule && rule.StorageResolution != 0 {
+			resolution = rule.StorageResolution
+		}
+		if highResTag {
+			resolution = 1
+		}
+		if tagRes, ok := tags[field+"_resolution"]; ok {
+			if tagRes == "high" {
+				resolution = 1
+			} else if parsed, err := strconv.ParseInt(tagRes, 10, 32); err == nil {
+				resolution = int32(parsed)
+			}
+		}
+		datums[i].StorageResolution = aws.Int32(resolution)
+	}
+
+	return datums
+}
+
+// PartitionDatums breaks datums into chunks of at most size, preserving
+// order, so callers stay within the CloudWatch PutMetricData per-request
+// datum limit.
+func PartitionDatums(size int, datums []types.MetricDatum) [][]types.MetricDatum {
+	numFullPartitions := len(datums) / size
+	partitions := make([][]types.MetricDatum, 0, numFullPartitions+1)
+
+	for i := 0; i < numFullPartitions; i++ {
+		partitions = append(partitions, datums[i*size:(i+1)*size])
+	}
+	if remainder := len(datums) % size; remainder != 0 {
+		partitions = append(partitions, datums[numFullPartitions*size:])
+	}
+
+	return partitions
+}
+
+// emfRecord is the shape of a CloudWatch Embedded Metric Format log record.
+// See the AWS documentation for "Embedded metric format specification".
+type emfRecord struct {
+	AWS emfMetadata `json:"_aws"`
+}
+
+type emfMetadata struct {
+	Timestamp         int64             `json:"Timestamp"`
+	CloudWatchMetrics []emfMetricsEntry `json:"CloudWatchMetrics"`
+}
+
+type emfMetricsEntry struct {
+	Namespace  string          `json:"Namespace"`
+	Dimensions [][]string      `json:"Dimensions"`
+	Metrics    []emfMetricSpec `json:"Metrics"`
+}
+
+type emfMetricSpec struct {
+	Name              string `json:"Name"`
+	Unit              string `json:"Unit,omitempty"`
+	StorageResolution int32  `json:"StorageResolution,omitempty"`
+}
+
+// buildEMFRecords converts a single Telegraf metric into one EMF log record
+// per numeric field. Unlike BuildMetricDatum, all fields of an EMF record
+// share one JSON document: the field value and every dimension value are
+// flattened alongside the "_aws" metadata block.
+func (c *CloudWatch) buildEMFRecords(point telegraf.Metric) []string {
+	resolution := int32(60)
+	if c.HighResolutionMetrics {
+		resolution = 1
+	}
+
+	dimensionSets := c.DimensionSets
+	if len(dimensionSets) == 0 {
+		var names []string
+		for _, d := range BuildDimensions(point.Tags()) {
+			names = append(names, *d.Name)
+		}
+		if len(names) > 0 {
+			dimensionSets = [][]string{names}
+		}
+	}
+
+	var records []string
+	for field, raw := range point.Fields() {
+		value, ok := convertField(raw)
+		if !ok || !validCloudWatchValue(value) {
+			continue
+		}
+
+		name := strings.Join([]string{point.Name(), field}, "_")
+		record := map[string]interface{}{
+			"_aws": emfMetadata{
+				Timestamp: point.Time().UnixMilli(),
+				CloudWatchMetrics: []emfMetricsEntry{
+					{
+						Namespace:  c.Namespace,
+						Dimensions: dimensionSets,
+						Metrics: []emfMetricSpec{
+							{Name: name, StorageResolution: resolution},
+						},
+					},
+				},
+			},
+			name: value,
+		}
+		for k, v := range point.Tags() {
+			if v != "" {
+				record[k] = v
+			}
+		}
+
+		encoded, err := json.Marshal(record)
+		if err != nil {
+			if c.Log != nil {
+				c.Log.Errorf("unable to encode EMF record: %v", err)
+			}
+			continue
+		}
+		records = append(records, string(encoded))
+	}
+	return records
+}
+
+func (c *CloudWatch) writeEMF(metrics []telegraf.Metric) error {
+	var events []cwltypes.InputLogEvent
+	for _, m := range metrics {
+		for _, record := range c.buildEMFRecords(m) {
+			events = append(events, cwltypes.InputLogEvent{
+				Message:   aws.String(record),
+				Timestamp: aws.Int64(m.Time().UnixMilli()),
+			})
+		}
+	}
+	if len(events) == 0 {
+		return nil
+	}
+
+	sort.Slice(events, func(i, j int) bool {
+		return *events[i].Timestamp < *events[j].Timestamp
+	})
+
+	ctx := context.Background()
+	out, err := c.logsClient.PutLogEvents(ctx, &cloudwatchlogs.PutLogEventsInput{
+		LogGroupName:  aws.String(c.LogGroup),
+		LogStreamName: aws.String(c.LogStream),
+		LogEvents:     events,
+		SequenceToken: c.sequenceToken,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to write EMF records to CloudWatch Logs: %w", err)
+	}
+	c.sequenceToken = out.NextSequenceToken
+	return nil
+}
+
+// ensureLogStream creates the configured log group/stream if they do not
+// already exist, and records the current upload sequence token so the first
+// PutLogEvents call succeeds.
+func (c *CloudWatch) ensureLogStream() error {
+	ctx := context.Background()
+
+	_, err := c.logsClient.CreateLogGroup(ctx, &cloudwatchlogs.CreateLogGroupInput{
+		LogGroupName: aws.String(c.LogGroup),
+	})
+	if err != nil && !isResourceAlreadyExists(err) {
+		return fmt.Errorf("unable to create log group %q: %w", c.LogGroup, err)
+	}
+
+	_, err = c.logsClient.CreateLogStream(ctx, &cloudwatchlogs.CreateLogStreamInput{
+		LogGroupName:  aws.String(c.LogGroup),
+		LogStreamName: aws.String(c.LogStream),
+	})
+	if err != nil && !isResourceAlreadyExists(err) {
+		return fmt.Errorf("unable to create log stream %q: %w", c.LogStream, err)
+	}
+
+	streams, err := c.logsClient.DescribeLogStreams(ctx, &cloudwatchlogs.DescribeLogStreamsInput{
+		LogGroupName:        aws.String(c.LogGroup),
+		LogStreamNamePrefix: aws.String(c.LogStream),
+	})
+	if err != nil {
+		return fmt.Errorf("unable to describe log stream %q: %w", c.LogStream, err)
+	}
+	for _, s := range streams.LogStreams {
+		if aws.ToString(s.LogStreamName) == c.LogStream {
+			c.sequenceToken = s.UploadSequenceToken
+			break
+		}
+	}
+
+	return nil
+}
+
+func isResourceAlreadyExists(err error) bool {
+	var alreadyExists *cwltypes.ResourceAlreadyExistsException
+	return errors.As(err, &alreadyExists)
+}
+
+func init() {
+	outputs.Add("cloudwatch", func() telegraf.Output {
+		return &CloudWatch{
+			Namespace: "InfluxData/Telegraf",
+		}
+	})
+}
@@ -1,14 +1,20 @@
 package cloudwatch
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
 	"math"
 	"sort"
+	"sync"
 	"testing"
+	"text/template"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/aws/smithy-go"
 	"github.com/influxdata/telegraf"
 	"github.com/influxdata/telegraf/metric"
 	"github.com/influxdata/telegraf/testutil"
@@ -168,3 +174,375 @@ func TestPartitionDatums(t *testing.T) {
 	assert.Equal([][]types.MetricDatum{twoDatum}, PartitionDatums(2, twoDatum))
 	assert.Equal([][]types.MetricDatum{twoDatum, oneDatum}, PartitionDatums(2, threeDatum))
 }
+
+// Test that cumulative histogram buckets are converted into a Values/Counts
+// distribution, each count being the increase over the previous bucket.
+func TestBuildDistributionDatumsFromBuckets(t *testing.T) {
+	assert := assert.New(t)
+
+	tags := map[string]string{"host": "example.org"}
+	group := []telegraf.Metric{
+		metric.New("latency", mergeTags(tags, "le", "0.1"), map[string]interface{}{"value_bucket": float64(5)}, time.Unix(0, 0)),
+		metric.New("latency", mergeTags(tags, "le", "0.5"), map[string]interface{}{"value_bucket": float64(12)}, time.Unix(0, 0)),
+		metric.New("latency", mergeTags(tags, "le", "1"), map[string]interface{}{"value_bucket": float64(20)}, time.Unix(0, 0)),
+	}
+
+	c := &CloudWatch{WriteDistributions: true}
+	distributions, rest := c.buildDistributionDatums(group)
+
+	require.Len(t, rest, 0)
+	require.Len(t, distributions, 1)
+	assert.Equal("latency_value", *distributions[0].datum.MetricName)
+	assert.Equal([]float64{0.1, 0.5, 1}, distributions[0].datum.Values)
+	assert.Equal([]float64{5, 7, 8}, distributions[0].datum.Counts)
+}
+
+// Test that the trailing "le=+Inf" bucket telegraf's histogram aggregator
+// always emits for the cumulative total is dropped rather than producing a
+// non-finite Values entry CloudWatch would reject.
+func TestBuildDistributionDatumsFromBucketsDropsInfBucket(t *testing.T) {
+	assert := assert.New(t)
+
+	tags := map[string]string{"host": "example.org"}
+	group := []telegraf.Metric{
+		metric.New("latency", mergeTags(tags, "le", "0.1"), map[string]interface{}{"value_bucket": float64(5)}, time.Unix(0, 0)),
+		metric.New("latency", mergeTags(tags, "le", "0.5"), map[string]interface{}{"value_bucket": float64(12)}, time.Unix(0, 0)),
+		metric.New("latency", mergeTags(tags, "le", "+Inf"), map[string]interface{}{"value_bucket": float64(20)}, time.Unix(0, 0)),
+	}
+
+	c := &CloudWatch{WriteDistributions: true}
+	distributions, rest := c.buildDistributionDatums(group)
+
+	require.Len(t, rest, 0)
+	require.Len(t, distributions, 1)
+	assert.Equal("latency_value", *distributions[0].datum.MetricName)
+	assert.Equal([]float64{0.1, 0.5}, distributions[0].datum.Values)
+	assert.Equal([]float64{5, 7}, distributions[0].datum.Counts)
+	for _, v := range distributions[0].datum.Values {
+		assert.False(math.IsInf(v, 0))
+	}
+}
+
+// Test that a distribution with more than 150 values is split across
+// multiple datums.
+func TestSplitDistributionDatums(t *testing.T) {
+	require := require.New(t)
+
+	values := make([]float64, 200)
+	counts := make([]float64, 200)
+	for i := range values {
+		values[i] = float64(i)
+		counts[i] = 1
+	}
+
+	datums := splitDistributionDatums("metric_value", map[string]string{}, time.Unix(0, 0), 60, values, counts)
+
+	require.Len(datums, 2)
+	require.Len(datums[0].Values, 150)
+	require.Len(datums[1].Values, 50)
+}
+
+// Test that a FieldRule's unit applies, a per-field unit tag and the
+// resolution=high tag apply, and reserved tags don't leak through as
+// dimensions.
+func TestApplyFieldRules(t *testing.T) {
+	assert := assert.New(t)
+
+	point := metric.New(
+		"cpu",
+		map[string]string{"host": "example.org", "resolution": "high", "latency_unit": "Milliseconds"},
+		map[string]interface{}{"latency": float64(12), "throughput": float64(3)},
+		time.Unix(0, 0),
+	)
+
+	c := &CloudWatch{
+		FieldRules: []FieldRule{
+			{NameGlob: "cpu_throughput", Unit: "Count/Second", StorageResolution: 60},
+		},
+	}
+
+	datums := BuildMetricDatum(false, false, stripReservedTags(point))
+	datums = c.applyFieldRules(point, datums)
+
+	byName := map[string]types.MetricDatum{}
+	for _, d := range datums {
+		byName[*d.MetricName] = d
+		for _, dim := range d.Dimensions {
+			assert.NotEqual("resolution", *dim.Name)
+			assert.NotEqual("latency_unit", *dim.Name)
+		}
+	}
+
+	assert.Equal(types.StandardUnitMilliseconds, byName["cpu_latency"].Unit)
+	assert.Equal(int32(1), *byName["cpu_latency"].StorageResolution, "resolution=high tag should force 1s resolution")
+	assert.Equal(types.StandardUnitCountSecond, byName["cpu_throughput"].Unit)
+}
+
+// Test that a tag merely ending in "_unit"/"_resolution" is left alone as
+// an ordinary dimension unless it actually names one of the metric's
+// fields, so a tag like "screen_resolution" isn't mistaken for a
+// "<field>_resolution" control tag.
+func TestStripReservedTagsOnlyFieldScoped(t *testing.T) {
+	assert := assert.New(t)
+
+	point := metric.New(
+		"display",
+		map[string]string{"host": "example.org", "screen_resolution": "1920x1080", "flow_unit": "gpm"},
+		map[string]interface{}{"latency": float64(12)},
+		time.Unix(0, 0),
+	)
+
+	sanitized := stripReservedTags(point)
+
+	assert.Equal("1920x1080", sanitized.Tags()["screen_resolution"])
+	assert.Equal("gpm", sanitized.Tags()["flow_unit"])
+}
+
+// Test that a batch of datums exceeding a byte budget is split into
+// multiple size-bounded partitions without dropping any datum.
+func TestSplitDatumsBySize(t *testing.T) {
+	require := require.New(t)
+
+	datums := make([]types.MetricDatum, 10)
+	for i := range datums {
+		datums[i] = types.MetricDatum{
+			MetricName: aws.String(fmt.Sprintf("Foo%d", i)),
+			Value:      aws.Float64(1),
+		}
+	}
+
+	partitions := splitDatumsBySize(datums, 200)
+
+	require.Greater(len(partitions), 1)
+
+	var total int
+	for _, p := range partitions {
+		total += len(p)
+	}
+	require.Equal(len(datums), total)
+}
+
+// Test that dimensions_priority orders kept dimensions and
+// dimensions_replacement collapses the rest into one hashed dimension.
+func TestBuildConfiguredDimensionsReplacement(t *testing.T) {
+	assert := assert.New(t)
+
+	tags := map[string]string{
+		"a": "1", "b": "2", "c": "3", "d": "4", "e": "5",
+		"f": "6", "g": "7", "h": "8", "i": "9", "j": "10", "k": "11",
+	}
+	c := &CloudWatch{
+		DimensionsPriority:    []string{"k", "j"},
+		DimensionsReplacement: "_extra",
+	}
+
+	dims := c.buildConfiguredDimensions(tags)
+
+	require.Len(t, dims, 10)
+	assert.Equal("k", *dims[0].Name)
+	assert.Equal("j", *dims[1].Name)
+	assert.Equal("_extra", *dims[len(dims)-1].Name)
+}
+
+// Test that the cardinality guard allows up to the limit of distinct
+// dimension-value combinations per metric name, then drops the rest.
+func TestCardinalityTrackerEnforcesLimit(t *testing.T) {
+	assert := assert.New(t)
+
+	tracker := newCardinalityTracker(2, nil)
+
+	dimsFor := func(v string) []types.Dimension {
+		return []types.Dimension{{Name: aws.String("request_id"), Value: aws.String(v)}}
+	}
+
+	assert.True(tracker.allow("api_latency", dimsFor("a")))
+	assert.True(tracker.allow("api_latency", dimsFor("b")))
+	assert.False(tracker.allow("api_latency", dimsFor("c")))
+	assert.True(tracker.allow("api_latency", dimsFor("a")), "a previously-seen combination should still be allowed")
+}
+
+// Test that a compiled metric_name_template overrides the default name and
+// falls back to it when the template errors.
+func TestRenderTemplate(t *testing.T) {
+	assert := assert.New(t)
+
+	tmpl, err := template.New("t").Parse("{{.Name}}.{{.Field}}")
+	require.NoError(t, err)
+
+	name, ok := renderTemplate(tmpl, templateData{Name: "cpu", Field: "usage", Tags: map[string]string{}})
+	assert.True(ok)
+	assert.Equal("cpu.usage", name)
+
+	missingKey, err := template.New("missing").Option("missingkey=error").Parse("{{.Tags.env}}")
+	require.NoError(t, err)
+	_, ok = renderTemplate(missingKey, templateData{Name: "cpu", Field: "usage", Tags: map[string]string{}})
+	assert.False(ok, "a template referencing a missing tag should fall back rather than erroring out")
+
+	_, ok = renderTemplate(nil, templateData{})
+	assert.False(ok)
+}
+
+// Test that the actual templates Init compiles - not a hand-rolled
+// substitute - fall back on a missing tag, since text/template only errors
+// on a missing map key when missingkey=error is set.
+func TestInitNamespaceTemplateFallsBackOnMissingTag(t *testing.T) {
+	assert := assert.New(t)
+
+	c := &CloudWatch{Namespace: "InfluxData/Telegraf", NamespaceTemplate: "MyApp/{{.Tags.env}}"}
+	require.NoError(t, c.Init())
+
+	_, ok := renderTemplate(c.namespaceTmpl, templateData{Name: "cpu", Field: "usage", Tags: map[string]string{}})
+	assert.False(ok, "a namespace_template referencing a missing tag should fall back to the default namespace")
+
+	name, ok := renderTemplate(c.namespaceTmpl, templateData{Name: "cpu", Field: "usage", Tags: map[string]string{"env": "prod"}})
+	assert.True(ok)
+	assert.Equal("MyApp/prod", name)
+}
+
+// fakePutMetricDataAPI is a test double for putMetricDataAPI, standing in
+// for *cloudwatch.Client so the retry/backoff logic can be exercised
+// without a network round trip.
+type fakePutMetricDataAPI struct {
+	mu        sync.Mutex
+	failTimes int
+	calls     int
+	datums    int
+}
+
+func (f *fakePutMetricDataAPI) PutMetricData(_ context.Context, params *cloudwatch.PutMetricDataInput, _ ...func(*cloudwatch.Options)) (*cloudwatch.PutMetricDataOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+	if f.calls <= f.failTimes {
+		return nil, &smithy.GenericAPIError{Code: "Throttling", Message: "slow down"}
+	}
+	f.datums += len(params.MetricData)
+	return &cloudwatch.PutMetricDataOutput{}, nil
+}
+
+// Test that a throttled request is retried and succeeds once the fake
+// client stops returning Throttling.
+func TestPutMetricDataWithRetryRetriesOnThrottling(t *testing.T) {
+	require := require.New(t)
+
+	fake := &fakePutMetricDataAPI{failTimes: 1}
+	c := &CloudWatch{client: fake, MaxRetryAttempts: 2}
+
+	err := c.putMetricDataWithRetry("ns", []types.MetricDatum{{MetricName: aws.String("m")}})
+
+	require.NoError(err)
+	require.Equal(2, fake.calls)
+	require.Equal(1, fake.datums)
+}
+
+// Test that retries stop and the error surfaces once maxRetryAttempts is
+// exhausted.
+func TestPutMetricDataWithRetryGivesUpAfterMaxAttempts(t *testing.T) {
+	require := require.New(t)
+
+	fake := &fakePutMetricDataAPI{failTimes: 10}
+	c := &CloudWatch{client: fake, MaxRetryAttempts: 1}
+
+	err := c.putMetricDataWithRetry("ns", []types.MetricDatum{{MetricName: aws.String("m")}})
+
+	require.Error(err)
+	require.Equal(2, fake.calls, "should attempt once plus one retry before giving up")
+}
+
+// Test that buildEMFRecords emits one record per numeric field, carrying
+// the field's own value/name, the configured namespace, tags flattened
+// alongside "_aws", and dimensions built from the metric's own tags when
+// dimension_sets isn't set.
+func TestBuildEMFRecordsFieldShape(t *testing.T) {
+	require := require.New(t)
+
+	point := metric.New(
+		"cpu",
+		map[string]string{"host": "example.org"},
+		map[string]interface{}{"usage": float64(42), "idle": float64(58)},
+		time.Unix(100, 0),
+	)
+
+	c := &CloudWatch{Namespace: "InfluxData/Telegraf"}
+	records := c.buildEMFRecords(point)
+	require.Len(records, 2)
+
+	byName := map[string]map[string]interface{}{}
+	for _, raw := range records {
+		var decoded map[string]interface{}
+		require.NoError(json.Unmarshal([]byte(raw), &decoded))
+
+		emfMeta, ok := decoded["_aws"].(map[string]interface{})
+		require.True(ok)
+		metrics := emfMeta["CloudWatchMetrics"].([]interface{})
+		require.Len(metrics, 1)
+		entry := metrics[0].(map[string]interface{})
+		require.Equal("InfluxData/Telegraf", entry["Namespace"])
+		dims := entry["Dimensions"].([]interface{})
+		require.Len(dims, 1)
+		require.Equal([]interface{}{"host"}, dims[0])
+
+		specs := entry["Metrics"].([]interface{})
+		require.Len(specs, 1)
+		name := specs[0].(map[string]interface{})["Name"].(string)
+		byName[name] = decoded
+	}
+
+	require.Contains(byName, "cpu_usage")
+	require.Contains(byName, "cpu_idle")
+	require.Equal(float64(42), byName["cpu_usage"]["cpu_usage"])
+	require.Equal("example.org", byName["cpu_usage"]["host"])
+}
+
+// Test that an explicit dimension_sets config overrides the default
+// tags-derived dimension set.
+func TestBuildEMFRecordsDimensionSets(t *testing.T) {
+	require := require.New(t)
+
+	point := metric.New(
+		"cpu",
+		map[string]string{"host": "example.org", "region": "us-east-1"},
+		map[string]interface{}{"usage": float64(42)},
+		time.Unix(100, 0),
+	)
+
+	c := &CloudWatch{Namespace: "InfluxData/Telegraf", DimensionSets: [][]string{{"region"}}}
+	records := c.buildEMFRecords(point)
+	require.Len(records, 1)
+
+	var decoded map[string]interface{}
+	require.NoError(json.Unmarshal([]byte(records[0]), &decoded))
+	emfMeta := decoded["_aws"].(map[string]interface{})
+	entry := emfMeta["CloudWatchMetrics"].([]interface{})[0].(map[string]interface{})
+	dims := entry["Dimensions"].([]interface{})
+	require.Len(dims, 1)
+	require.Equal([]interface{}{"region"}, dims[0])
+}
+
+// Test that a non-finite or out-of-range field value is skipped rather than
+// producing a record CloudWatch would reject.
+func TestBuildEMFRecordsSkipsInvalidValues(t *testing.T) {
+	require := require.New(t)
+
+	point := metric.New(
+		"cpu",
+		map[string]string{"host": "example.org"},
+		map[string]interface{}{"usage": float64(42), "broken": math.Inf(1), "text": "not-a-number"},
+		time.Unix(100, 0),
+	)
+
+	c := &CloudWatch{Namespace: "InfluxData/Telegraf"}
+	records := c.buildEMFRecords(point)
+
+	require.Len(records, 1)
+	require.Contains(records[0], "cpu_usage")
+}
+
+func mergeTags(tags map[string]string, key, value string) map[string]string {
+	out := make(map[string]string, len(tags)+1)
+	for k, v := range tags {
+		out[k] = v
+	}
+	out[key] = value
+	return out
+}